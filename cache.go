@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"hash/fnv"
+	"io"
+	"sync"
+)
+
+// CachePolicy selects the eviction strategy for the read cache.
+type CachePolicy string
+
+const (
+	CachePolicyNone CachePolicy = "none"
+	CachePolicyLRU  CachePolicy = "lru"
+	CachePolicyLFU  CachePolicy = "lfu"
+)
+
+// cacheShardCount is the number of independent shards the cache is split
+// into, so that 48 workers hashing to different objects don't all contend
+// on one lock the way a single bigcache-style map would.
+const cacheShardCount = 32
+
+// cacheEntry is one cached object's payload plus whatever bookkeeping its
+// eviction policy needs.
+type cacheEntry struct {
+	key  string
+	data []byte
+	freq int64
+	elem *list.Element // LRU recency position; unused under LFU
+}
+
+// cacheShard is one lock-guarded slice of the cache, holding its own bytes
+// budget so eviction never has to reach across shards.
+type cacheShard struct {
+	mu       sync.Mutex
+	policy   CachePolicy
+	maxBytes int64
+	bytes    int64
+	entries  map[string]*cacheEntry
+	lru      *list.List // most-recently-used at the front
+}
+
+func newCacheShard(policy CachePolicy, maxBytes int64) *cacheShard {
+	return &cacheShard{
+		policy:   policy,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*cacheEntry),
+		lru:      list.New(),
+	}
+}
+
+func (s *cacheShard) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry.freq++
+	if s.policy == CachePolicyLRU {
+		s.lru.MoveToFront(entry.elem)
+	}
+	return entry.data, true
+}
+
+// put admits data under key, evicting entries by total bytes (not entry
+// count) until there's room. It's a no-op if data alone is larger than the
+// shard's entire budget.
+func (s *cacheShard) put(key string, data []byte) {
+	if int64(len(data)) > s.maxBytes {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.entries[key]; ok {
+		s.bytes -= int64(len(existing.data))
+		if s.policy == CachePolicyLRU {
+			s.lru.Remove(existing.elem)
+		}
+		delete(s.entries, key)
+	}
+
+	for s.bytes+int64(len(data)) > s.maxBytes && len(s.entries) > 0 {
+		s.evictOneLocked()
+	}
+
+	entry := &cacheEntry{key: key, data: data}
+	if s.policy == CachePolicyLRU {
+		entry.elem = s.lru.PushFront(key)
+	}
+	s.entries[key] = entry
+	s.bytes += int64(len(data))
+}
+
+// evictOneLocked removes a single entry chosen by the shard's policy.
+// Callers must hold s.mu.
+func (s *cacheShard) evictOneLocked() {
+	var victim string
+
+	switch s.policy {
+	case CachePolicyLRU:
+		back := s.lru.Back()
+		if back == nil {
+			return
+		}
+		victim = back.Value.(string)
+	case CachePolicyLFU:
+		// Shards are small enough that a linear scan for the coldest entry
+		// is cheap relative to the network round trip it saves us from.
+		var minFreq int64 = -1
+		for key, entry := range s.entries {
+			if minFreq == -1 || entry.freq < minFreq {
+				minFreq = entry.freq
+				victim = key
+			}
+		}
+	}
+
+	if entry, ok := s.entries[victim]; ok {
+		s.bytes -= int64(len(entry.data))
+		if s.policy == CachePolicyLRU {
+			s.lru.Remove(entry.elem)
+		}
+		delete(s.entries, victim)
+	}
+}
+
+// ShardedCache is an in-process, memory-bounded object cache split across
+// cacheShardCount independent shards, each with its own byte budget and
+// lock.
+type ShardedCache struct {
+	policy CachePolicy
+	shards [cacheShardCount]*cacheShard
+}
+
+// NewShardedCache builds a cache with the given policy and total size
+// budget, split evenly across shards. It returns nil if policy is
+// CachePolicyNone or totalSizeBytes is non-positive, so callers can treat a
+// nil *ShardedCache as "caching disabled".
+func NewShardedCache(policy CachePolicy, totalSizeBytes int64) *ShardedCache {
+	if policy == CachePolicyNone || totalSizeBytes <= 0 {
+		return nil
+	}
+
+	c := &ShardedCache{policy: policy}
+	perShard := totalSizeBytes / cacheShardCount
+	for i := range c.shards {
+		c.shards[i] = newCacheShard(policy, perShard)
+	}
+	return c
+}
+
+// CanCache reports whether an object of the given size could ever be
+// admitted to the shard key hashes to. Callers should check this before
+// buffering the object's bytes into memory, since put silently rejects
+// anything over its shard's budget and there's no point paying that
+// allocation (and skewing the read it's timing) for an object that was
+// always going to be rejected.
+func (c *ShardedCache) CanCache(key string, size int64) bool {
+	if c == nil {
+		return false
+	}
+	return size <= c.shardFor(key).maxBytes
+}
+
+func (c *ShardedCache) shardFor(key string) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return c.shards[h.Sum32()%cacheShardCount]
+}
+
+// Get returns the cached bytes for key, if present.
+func (c *ShardedCache) Get(key string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.shardFor(key).get(key)
+}
+
+// Put admits data under key into the cache, if it fits under the owning
+// shard's per-entry-implied budget.
+func (c *ShardedCache) Put(key string, data []byte) {
+	if c == nil {
+		return
+	}
+	c.shardFor(key).put(key, data)
+}
+
+// readCachedObject copies the cached bytes in data to io.Discard,
+// mirroring the shape of a real read so downstream latency/throughput
+// numbers stay comparable to a cache miss.
+func readCachedObject(data []byte) error {
+	_, err := io.Copy(io.Discard, bytes.NewReader(data))
+	return err
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
 	"strconv"
@@ -21,15 +23,32 @@ import (
 	_ "google.golang.org/grpc/xds/googledirectpath"
 )
 
+// API identifies which transport/surface a given operation should use.
+// MIXED means a transport is chosen at random for every individual operation,
+// which is useful for simulating a fleet that isn't pinned to one API.
+type API string
+
+const (
+	JSON       API = "JSON"
+	XML        API = "XML"
+	GRPC       API = "GRPC"
+	DirectPath API = "DirectPath"
+	MIXED      API = "MIXED"
+)
+
+// OpType is the kind of operation a worker performs for a given work item.
+type OpType string
+
+const (
+	OpRead  OpType = "read"
+	OpWrite OpType = "write"
+)
+
 var (
 	GrpcConnPoolSize    = 1
 	MaxConnsPerHost     = 100
 	MaxIdelConnsPerHost = 100
 
-	NumOfWorker = 48
-
-	NumOfReadCallPerWorker = 800
-
 	MaxRetryDuration = 30 * time.Second
 
 	RetryMultiplier = 2.0
@@ -46,6 +65,114 @@ var (
 	eG errgroup.Group
 )
 
+// BenchmarkConfig holds all the knobs for a single run, populated from flags.
+type BenchmarkConfig struct {
+	NumOfWorker int
+
+	MinObjectSize int64
+	MaxObjectSize int64
+
+	ReadRatio  float64
+	WriteRatio float64
+
+	Duration   time.Duration
+	MaxSamples int64
+
+	Api API
+}
+
+// APIClient is the common surface every transport (JSON, XML, gRPC,
+// DirectPath) implements, so the benchmark loop can stay agnostic to which
+// one it's driving for a given work item. Both methods report back the API
+// that actually served the call, so a MIXED client's random per-call choice
+// isn't lost to the caller.
+type APIClient interface {
+	ReadObject(ctx context.Context, objectName string) (io.ReadCloser, API, error)
+	WriteObject(ctx context.Context, objectName string, size int64) (API, error)
+	Close() error
+}
+
+// storageAPIClient adapts a *storage.Client, plus the bucket it talks to, to
+// the APIClient interface. The same adapter backs JSON, XML, gRPC and
+// DirectPath: what differs between them is how the underlying
+// *storage.Client was constructed, recorded in api so calls can report it.
+type storageAPIClient struct {
+	client *storage.Client
+	bucket *storage.BucketHandle
+	api    API
+}
+
+func (c *storageAPIClient) ReadObject(ctx context.Context, objectName string) (io.ReadCloser, API, error) {
+	rc, err := c.bucket.Object(objectName).NewReader(ctx)
+	return rc, c.api, err
+}
+
+func (c *storageAPIClient) WriteObject(ctx context.Context, objectName string, size int64) (API, error) {
+	w := c.bucket.Object(objectName).NewWriter(ctx)
+	if _, err := io.CopyN(w, newZeroReader(), size); err != nil {
+		w.Close()
+		return c.api, fmt.Errorf("while writing object content: %v", err)
+	}
+	return c.api, w.Close()
+}
+
+func (c *storageAPIClient) Close() error {
+	return c.client.Close()
+}
+
+// zeroReader is an io.Reader that yields an endless stream of zero bytes,
+// used to synthesize writes of a given size without allocating real payload
+// data.
+type zeroReader struct{}
+
+func newZeroReader() *zeroReader { return &zeroReader{} }
+
+func (z *zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+// mixedAPIClient fans each call out to one of the underlying per-API clients,
+// chosen at random, so a single benchmark run can exercise JSON, XML, gRPC
+// and DirectPath traffic concurrently.
+type mixedAPIClient struct {
+	clients []APIClient
+}
+
+func (c *mixedAPIClient) pick() APIClient {
+	return c.clients[rand.Intn(len(c.clients))]
+}
+
+func (c *mixedAPIClient) ReadObject(ctx context.Context, objectName string) (io.ReadCloser, API, error) {
+	return c.pick().ReadObject(ctx, objectName)
+}
+
+func (c *mixedAPIClient) WriteObject(ctx context.Context, objectName string, size int64) (API, error) {
+	return c.pick().WriteObject(ctx, objectName, size)
+}
+
+func (c *mixedAPIClient) Close() error {
+	var err error
+	for _, client := range c.clients {
+		if cErr := client.Close(); cErr != nil {
+			err = cErr
+		}
+	}
+	return err
+}
+
+// WorkItem is a single unit of work pulled off the shared job channel by a
+// worker: which object to touch, how big it should be (for writes), which
+// API to drive it through, and whether to read or write.
+type WorkItem struct {
+	ObjectName string
+	Size       int64
+	Api        API
+	Op         OpType
+}
+
 func CreateHttpClient(ctx context.Context, isHttp2 bool) (client *storage.Client, err error) {
 	var transport *http.Transport
 	// Using http1 makes the client more performant.
@@ -90,13 +217,19 @@ func CreateHttpClient(ctx context.Context, isHttp2 bool) (client *storage.Client
 	return storage.NewClient(ctx, option.WithHTTPClient(httpClient))
 }
 
-func CreateGrpcClient(ctx context.Context) (client *storage.Client, err error) {
+// CreateGrpcClient builds a gRPC storage client. enableDirectPath gates
+// whether it resolves over DirectPath (GOOGLE_CLOUD_ENABLE_DIRECT_PATH_XDS)
+// or a plain gRPC channel, so GRPC and DirectPath stay distinct transports
+// instead of DirectPath resolution being forced on for both.
+func CreateGrpcClient(ctx context.Context, enableDirectPath bool) (client *storage.Client, err error) {
 	if err := os.Setenv("STORAGE_USE_GRPC", "gRPC"); err != nil {
 		log.Fatalf("error setting grpc env var: %v", err)
 	}
 
-	if err := os.Setenv("GOOGLE_CLOUD_ENABLE_DIRECT_PATH_XDS", "true"); err != nil {
-		log.Fatalf("error setting direct path env var: %v", err)
+	if enableDirectPath {
+		if err := os.Setenv("GOOGLE_CLOUD_ENABLE_DIRECT_PATH_XDS", "true"); err != nil {
+			log.Fatalf("error setting direct path env var: %v", err)
+		}
 	}
 
 	client, err = storage.NewClient(ctx, option.WithGRPCConnectionPool(GrpcConnPoolSize))
@@ -105,84 +238,397 @@ func CreateGrpcClient(ctx context.Context) (client *storage.Client, err error) {
 		log.Fatalf("error while unsetting grpc env var: %v", err)
 	}
 
-	if err := os.Unsetenv("GOOGLE_CLOUD_ENABLE_DIRECT_PATH_XDS"); err != nil {
-		log.Fatalf("error while unsetting direct path env var: %v", err)
+	if enableDirectPath {
+		if err := os.Unsetenv("GOOGLE_CLOUD_ENABLE_DIRECT_PATH_XDS"); err != nil {
+			log.Fatalf("error while unsetting direct path env var: %v", err)
+		}
 	}
 	return
 }
 
-func ReadObject(ctx context.Context, workerId int, bucketHandle *storage.BucketHandle) (err error) {
+// CreateAPIClient builds the APIClient backing a given API selector.
+// grpcConnPoolSize controls how many independent gRPC channels back GRPC and
+// DirectPath clients; 1 uses a plain storageAPIClient, >1 uses a
+// pooledGrpcClient. For MIXED, it builds one of each requested underlying
+// API and wraps them in a mixedAPIClient that picks between them per call.
+func CreateAPIClient(ctx context.Context, bucketHandle func(*storage.Client) *storage.BucketHandle, api API, grpcConnPoolSize int) (APIClient, error) {
+	switch api {
+	case JSON, XML:
+		// The JSON and XML surfaces are both served by the same HTTP client;
+		// which wire format is used is an implementation detail of the
+		// storage package based on the call being made.
+		client, err := CreateHttpClient(ctx, false)
+		if err != nil {
+			return nil, fmt.Errorf("while creating http client for %s: %v", api, err)
+		}
+		return &storageAPIClient{client: client, bucket: bucketHandle(client), api: api}, nil
+	case GRPC, DirectPath:
+		if grpcConnPoolSize > 1 {
+			return NewPooledGrpcClient(ctx, grpcConnPoolSize, BucketName, api)
+		}
+		client, err := CreateGrpcClient(ctx, api == DirectPath)
+		if err != nil {
+			return nil, fmt.Errorf("while creating grpc client for %s: %v", api, err)
+		}
+		return &storageAPIClient{client: client, bucket: bucketHandle(client), api: api}, nil
+	case MIXED:
+		var clients []APIClient
+		for _, sub := range []API{JSON, XML, GRPC, DirectPath} {
+			c, err := CreateAPIClient(ctx, bucketHandle, sub, grpcConnPoolSize)
+			if err != nil {
+				return nil, err
+			}
+			clients = append(clients, c)
+		}
+		return &mixedAPIClient{clients: clients}, nil
+	default:
+		return nil, fmt.Errorf("unknown api: %s", api)
+	}
+}
 
-	objectName := ObjectNamePrefix + strconv.Itoa(workerId) + ObjectNameSuffix
+// readOnce performs a single NewReader + io.Copy + Close against apiClient.
+// When capture is true, the object's bytes are collected and returned (for
+// cache admission); otherwise they're discarded as read. It also reports the
+// API that actually served the call, which for a MIXED apiClient isn't known
+// until the call is dispatched.
+func readOnce(ctx context.Context, apiClient APIClient, objectName string, capture bool) ([]byte, API, error) {
+	rc, usedAPI, err := apiClient.ReadObject(ctx, objectName)
+	if err != nil {
+		return nil, usedAPI, err
+	}
+
+	var data []byte
+	if capture {
+		var buf bytes.Buffer
+		_, err = io.Copy(&buf, rc)
+		data = buf.Bytes()
+	} else {
+		_, err = io.Copy(io.Discard, rc)
+	}
+	if err != nil {
+		rc.Close()
+		return nil, usedAPI, err
+	}
+	return data, usedAPI, rc.Close()
+}
 
-	for i := 0; i < NumOfReadCallPerWorker; i++ {
-		start := time.Now()
-		object := bucketHandle.Object(objectName)
-		rc, err := object.NewReader(ctx)
+// ReadObject reads objectName through apiClient and records the resulting
+// sample to sink. If cache has a hit for this object, the read is served
+// from memory and never reaches apiClient. Otherwise, if stallDetector is
+// enabled and has enough history for this object size, the read is bounded
+// by a dynamic timeout derived from the recent p99 latency; a read that
+// times out is counted as a stall and retried, as long as the run's
+// stall-retry budget allows it. A successful miss is admitted to cache if
+// CanCache reports that it fits.
+func ReadObject(ctx context.Context, apiClient APIClient, sink ResultsSink, stallDetector *StallDetector, cache *ShardedCache, item WorkItem, workerId int) (err error) {
+	sampleStart := time.Now()
+
+	if data, hit := cache.Get(item.ObjectName); hit {
+		err = readCachedObject(data)
+		sink.Record(Sample{
+			Op:         OpRead,
+			Api:        item.Api,
+			ObjectSize: item.Size,
+			Elapsed:    time.Since(sampleStart),
+			WorkerId:   workerId,
+			CacheHit:   true,
+			ErrorClass: errorClass(err),
+		})
 		if err != nil {
-			return fmt.Errorf("while creating reader object: %v", err)
+			return fmt.Errorf("while reading cached object: %v", err)
 		}
+		return nil
+	}
 
-		_, err = io.Copy(io.Discard, rc)
+	var stalls int
+	var stalled bool
+	var data []byte
+	usedAPI := item.Api
+	canCache := cache.CanCache(item.ObjectName, item.Size)
+
+	for {
+		readCtx := ctx
+		cancel := func() {}
+		if timeout := stallDetector.Timeout(item.Size); timeout > 0 {
+			readCtx, cancel = context.WithTimeout(ctx, timeout)
+		}
+
+		attemptStart := time.Now()
+		data, usedAPI, err = readOnce(readCtx, apiClient, item.ObjectName, canCache)
+		cancel()
+
+		if err == nil {
+			stallDetector.Record(item.Size, time.Since(attemptStart))
+			break
+		}
+		if readCtx.Err() != context.DeadlineExceeded {
+			break
+		}
+		stalled = true
+		if !stallDetector.TakeRetry() {
+			break
+		}
+		stalls++
+	}
+
+	if err == nil && canCache {
+		cache.Put(item.ObjectName, data)
+	}
+
+	sink.Record(Sample{
+		Op:         OpRead,
+		Api:        usedAPI,
+		ObjectSize: item.Size,
+		Elapsed:    time.Since(sampleStart),
+		WorkerId:   workerId,
+		RetryCount: stalls,
+		Stalled:    stalled,
+		ErrorClass: errorClass(err),
+	})
+
+	if err != nil {
+		return fmt.Errorf("while reading object: %v", err)
+	}
+	return nil
+}
+
+// WriteObject writes size bytes to objectName through apiClient once and
+// records the resulting sample to sink.
+func WriteObject(ctx context.Context, apiClient APIClient, sink ResultsSink, item WorkItem, workerId int) (err error) {
+	start := time.Now()
+
+	usedAPI, err := apiClient.WriteObject(ctx, item.ObjectName, item.Size)
+
+	sink.Record(Sample{
+		Op:         OpWrite,
+		Api:        usedAPI,
+		ObjectSize: item.Size,
+		Elapsed:    time.Since(start),
+		WorkerId:   workerId,
+		ErrorClass: errorClass(err),
+	})
+
+	if err != nil {
+		return fmt.Errorf("while writing object: %v", err)
+	}
+	return nil
+}
+
+// randomObjectSize samples a size uniformly from [min, max], inclusive.
+func randomObjectSize(min, max int64) int64 {
+	if max <= min {
+		return min
+	}
+	return min + rand.Int63n(max-min+1)
+}
+
+// pickOp chooses read or write for a single work item based on the
+// configured read/write ratio.
+func pickOp(cfg *BenchmarkConfig) OpType {
+	if rand.Float64() < cfg.ReadRatio/(cfg.ReadRatio+cfg.WriteRatio) {
+		return OpRead
+	}
+	return OpWrite
+}
+
+// generateJobs feeds the shared jobs channel until either cfg.Duration has
+// elapsed or cfg.MaxSamples items have been produced, whichever is
+// configured. It closes jobs when done so workers know to stop.
+func generateJobs(ctx context.Context, cfg *BenchmarkConfig, jobs chan<- WorkItem) {
+	defer close(jobs)
+
+	var produced int64
+	deadline := time.Time{}
+	if cfg.Duration > 0 {
+		deadline = time.Now().Add(cfg.Duration)
+	}
+
+	for workerId := 0; ; workerId = (workerId + 1) % cfg.NumOfWorker {
+		if cfg.MaxSamples > 0 && produced >= cfg.MaxSamples {
+			return
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return
+		}
+
+		item := WorkItem{
+			ObjectName: ObjectNamePrefix + strconv.Itoa(workerId) + ObjectNameSuffix,
+			Size:       randomObjectSize(cfg.MinObjectSize, cfg.MaxObjectSize),
+			Api:        cfg.Api,
+			Op:         pickOp(cfg),
+		}
+
+		select {
+		case jobs <- item:
+			produced++
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// runWorker drains the jobs channel, executing each work item against the
+// API client selected for it and recording one sample per work item.
+func runWorker(ctx context.Context, apiClients map[API]APIClient, sink ResultsSink, stallDetector *StallDetector, cache *ShardedCache, jobs <-chan WorkItem, workerId int) error {
+	for item := range jobs {
+		apiClient := apiClients[item.Api]
+
+		var err error
+		switch item.Op {
+		case OpRead:
+			err = ReadObject(ctx, apiClient, sink, stallDetector, cache, item, workerId)
+		case OpWrite:
+			err = WriteObject(ctx, apiClient, sink, item, workerId)
+		}
 		if err != nil {
-			return fmt.Errorf("while reading and discarding content: %v", err)
+			return fmt.Errorf("while running work item for %s: %w", item.ObjectName, err)
 		}
+	}
+	return nil
+}
 
-		duration := time.Since(start)
-		fmt.Println(duration)
+// applyRetryPolicy configures gax retry/backoff on every underlying
+// *storage.Client behind client, however many of them there are.
+func applyRetryPolicy(client APIClient) {
+	retry := []storage.RetryOption{
+		storage.WithBackoff(gax.Backoff{
+			Max:        MaxRetryDuration,
+			Multiplier: RetryMultiplier,
+		}),
+		storage.WithPolicy(storage.RetryAlways),
+	}
 
-		rc.Close()
+	switch c := client.(type) {
+	case *storageAPIClient:
+		c.client.SetRetry(retry...)
+	case *pooledGrpcClient:
+		for _, underlying := range c.clients {
+			underlying.SetRetry(retry...)
+		}
+	case *mixedAPIClient:
+		for _, underlying := range c.clients {
+			applyRetryPolicy(underlying)
+		}
 	}
+}
 
-	return
+// channelReporter is implemented by APIClients that dispatch across
+// multiple underlying channels/clients and can report a per-channel
+// breakdown of how much work each one did.
+type channelReporter interface {
+	ReportChannelCounts()
 }
 
 func main() {
-	clientProtocol := flag.String("client-protocol", "http", "# of iterations")
+	numOfWorker := flag.Int("workers", 48, "number of concurrent workers")
+	minObjectSize := flag.Int64("min_object_size", 50*1024*1024, "minimum object size in bytes, sampled per iteration")
+	maxObjectSize := flag.Int64("max_object_size", 50*1024*1024, "maximum object size in bytes, sampled per iteration")
+	readRatio := flag.Float64("read_ratio", 1, "relative weight of read operations in the workload mix")
+	writeRatio := flag.Float64("write_ratio", 0, "relative weight of write operations in the workload mix")
+	duration := flag.Duration("t", 0, "run for this long instead of a fixed sample count, e.g. -t 1h")
+	maxSamples := flag.Int64("max_samples", 0, "total number of operations to run; mutually exclusive with -t, defaults to 800*workers if neither is set")
+	api := flag.String("api", "JSON", "API to use: JSON, XML, GRPC, DirectPath, or MIXED")
+	outputType := flag.String("output_type", "csv", "where to send per-operation metrics: csv or cloud-monitoring")
+	outputFile := flag.String("o", "results.csv", "output file for -output_type=csv")
+	stallTimeoutEnabled := flag.Bool("stall-timeout-enabled", false, "cancel and retry reads that run far longer than recent history suggests they should")
+	stallTimeoutQuantile := flag.Float64("stall-timeout-quantile", 0.99, "quantile of recent read latencies used to derive the stall timeout")
+	stallTimeoutMultiplier := flag.Float64("stall-timeout-multiplier", 3, "stall timeout = multiplier * the tracked quantile latency")
+	stallTimeoutMinSamples := flag.Int("stall-timeout-min-samples", 1000, "minimum latency samples for an object-size bucket before stall detection activates for it")
+	grpcConnPoolSize := flag.Int("grpc-conn-pool", 1, "number of independent gRPC channels to spread GRPC/DirectPath calls across, round-robin")
+	cacheSizeMB := flag.Int64("cache-size-mb", 0, "total size of the in-process read cache, in MiB, split evenly across cacheShardCount shards; 0 disables caching. Must be large relative to object size * cacheShardCount for objects to be admitted at all")
+	cachePolicy := flag.String("cache-policy", "none", "read cache eviction policy: lru, lfu, or none")
 	flag.Parse()
 
+	const stallTimeoutFloor = 500 * time.Millisecond
+
+	// -t and -max_samples pick mutually exclusive stopping conditions for
+	// generateJobs; letting both be set would mean the shorter of the two
+	// silently wins, so require exactly one (falling back to a fixed sample
+	// count if neither was given).
+	if *duration > 0 && *maxSamples > 0 {
+		log.Fatalf("-t and -max_samples are mutually exclusive; set only one")
+	}
+	maxSamplesEffective := *maxSamples
+	if *duration == 0 && maxSamplesEffective == 0 {
+		maxSamplesEffective = int64(800 * *numOfWorker)
+	}
+
+	cfg := &BenchmarkConfig{
+		NumOfWorker:   *numOfWorker,
+		MinObjectSize: *minObjectSize,
+		MaxObjectSize: *maxObjectSize,
+		ReadRatio:     *readRatio,
+		WriteRatio:    *writeRatio,
+		Duration:      *duration,
+		MaxSamples:    maxSamplesEffective,
+		Api:           API(*api),
+	}
+
 	ctx := context.Background()
 
-	var client *storage.Client
-	var err error
-	if *clientProtocol == "http" {
-		client, err = CreateHttpClient(ctx, false)
-	} else {
-		client, err = CreateGrpcClient(ctx)
+	bucketHandle := func(client *storage.Client) *storage.BucketHandle {
+		return client.Bucket(BucketName)
 	}
 
+	setupClient, err := CreateHttpClient(ctx, false)
 	if err != nil {
-		fmt.Errorf("while creating the client: %v", err)
+		fmt.Fprintf(os.Stderr, "while creating setup client: %v\n", err)
+		os.Exit(1)
+	}
+	if err := setupClient.Bucket(BucketName).Create(ctx, ProjectName, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "while creating the bucket: %v\n", err)
 	}
+	setupClient.Close()
 
-	client.SetRetry(
-		storage.WithBackoff(gax.Backoff{
-			Max:        MaxRetryDuration,
-			Multiplier: RetryMultiplier,
-		}),
-		storage.WithPolicy(storage.RetryAlways))
+	// Build one APIClient per API we'll actually dispatch to, so MIXED runs
+	// don't pay for clients it never uses.
+	neededApis := []API{cfg.Api}
+	if cfg.Api == MIXED {
+		neededApis = []API{JSON, XML, GRPC, DirectPath}
+	}
 
-	bucketHandle := client.Bucket(BucketName)
-	err = bucketHandle.Create(ctx, ProjectName, nil)
+	apiClients := make(map[API]APIClient)
+	for _, a := range neededApis {
+		client, err := CreateAPIClient(ctx, bucketHandle, a, *grpcConnPoolSize)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "while creating api client: %v\n", err)
+			os.Exit(1)
+		}
+		applyRetryPolicy(client)
+		apiClients[a] = client
+	}
+	if cfg.Api == MIXED {
+		apiClients[MIXED] = &mixedAPIClient{clients: []APIClient{apiClients[JSON], apiClients[XML], apiClients[GRPC], apiClients[DirectPath]}}
+	}
 
+	sink, err := NewResultsSink(ctx, OutputType(*outputType), *outputFile, ProjectName)
 	if err != nil {
-		fmt.Errorf("while creating the bucket: %v", err)
+		fmt.Fprintf(os.Stderr, "while creating results sink: %v\n", err)
+		os.Exit(1)
 	}
+	defer sink.Close()
+
+	stallDetector := NewStallDetector(*stallTimeoutEnabled, *stallTimeoutQuantile, *stallTimeoutMultiplier, *stallTimeoutMinSamples, stallTimeoutFloor)
+	cache := NewShardedCache(CachePolicy(*cachePolicy), *cacheSizeMB*1024*1024)
 
-	for i := 0; i < NumOfWorker; i++ {
+	jobs := make(chan WorkItem, cfg.NumOfWorker)
+	go generateJobs(ctx, cfg, jobs)
+
+	for i := 0; i < cfg.NumOfWorker; i++ {
+		workerId := i
 		eG.Go(func() error {
-			idx := i
-			err = ReadObject(ctx, idx, bucketHandle)
-			if err != nil {
-				err = fmt.Errorf("while reading object: %w", err)
-				return err
-			}
-			return err
+			return runWorker(ctx, apiClients, sink, stallDetector, cache, jobs, workerId)
 		})
 	}
 
 	err = eG.Wait()
 
+	for _, client := range apiClients {
+		if reporter, ok := client.(channelReporter); ok {
+			reporter.ReportChannelCounts()
+		}
+	}
+
 	if err == nil {
 		fmt.Println("Read benchmark completed successfully!")
 	} else {
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// OutputType selects which ResultsSink backs a run.
+type OutputType string
+
+const (
+	OutputCSV             OutputType = "csv"
+	OutputCloudMonitoring OutputType = "cloud-monitoring"
+)
+
+// Sample is one recorded operation: everything needed to analyze throughput,
+// latency and error rates offline, or to export as a monitoring metric.
+type Sample struct {
+	Op         OpType
+	Api        API
+	ObjectSize int64
+	Elapsed    time.Duration
+	WorkerId   int
+	RetryCount int
+	// Stalled is true if at least one attempt at this operation was
+	// cancelled by the dynamic stall-timeout detector before it completed.
+	Stalled bool
+	// CacheHit is true if this read was served from the in-process object
+	// cache instead of reaching apiClient.
+	CacheHit bool
+	// ErrorClass is the empty string on success, otherwise a short tag
+	// describing what kind of error the operation failed with.
+	ErrorClass string
+}
+
+// ThroughputMiBps is the sample's effective transfer rate. It's zero for
+// failed samples, since no useful amount of the object was necessarily
+// transferred.
+func (s Sample) ThroughputMiBps() float64 {
+	if s.ErrorClass != "" || s.Elapsed <= 0 {
+		return 0
+	}
+	return float64(s.ObjectSize) / (1024 * 1024) / s.Elapsed.Seconds()
+}
+
+// ResultsSink is where the benchmark loop reports each completed operation.
+// Implementations must be safe for concurrent use, since every worker
+// records through the same sink.
+type ResultsSink interface {
+	Record(s Sample)
+	Close() error
+}
+
+// errorClass reduces an error down to a short, stable tag suitable for
+// grouping in a results sink. nil becomes the empty string.
+func errorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", err)
+}
+
+// csvSink writes one row per sample to the configured file. Rows are
+// flushed immediately so a long-running benchmark can be tailed or analyzed
+// before it finishes.
+type csvSink struct {
+	mu     sync.Mutex
+	file   *os.File
+	writer *csv.Writer
+}
+
+// NewCsvSink opens path (truncating it if it already exists), writes the
+// header row, and returns a ResultsSink that appends one CSV row per sample.
+func NewCsvSink(path string) (ResultsSink, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("while creating csv output file: %v", err)
+	}
+
+	w := csv.NewWriter(f)
+	if err := w.Write([]string{"op", "api", "object_size", "elapsed_ns", "throughput_mib_s", "worker_id", "retry_count", "stalled", "cache_hit", "error_class"}); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("while writing csv header: %v", err)
+	}
+	w.Flush()
+
+	return &csvSink{file: f, writer: w}, nil
+}
+
+func (s *csvSink) Record(sample Sample) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writer.Write([]string{
+		string(sample.Op),
+		string(sample.Api),
+		strconv.FormatInt(sample.ObjectSize, 10),
+		strconv.FormatInt(sample.Elapsed.Nanoseconds(), 10),
+		strconv.FormatFloat(sample.ThroughputMiBps(), 'f', 3, 64),
+		strconv.Itoa(sample.WorkerId),
+		strconv.Itoa(sample.RetryCount),
+		strconv.FormatBool(sample.Stalled),
+		strconv.FormatBool(sample.CacheHit),
+		sample.ErrorClass,
+	})
+	s.writer.Flush()
+}
+
+func (s *csvSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.writer.Flush()
+	if err := s.writer.Error(); err != nil {
+		return err
+	}
+	return s.file.Close()
+}
+
+// cloudMonitoringMetricType is the custom metric the benchmark exports each
+// sample's latency under. Cloud Monitoring requires custom metrics to live
+// under the custom.googleapis.com/ namespace.
+const cloudMonitoringMetricType = "custom.googleapis.com/gcs_benchmark/op_latency"
+
+// cloudMonitoringFlushInterval is how often buffered samples are exported.
+// Cloud Monitoring rejects a point that isn't strictly newer than the last
+// one written to the same series, so every series can be written at most
+// once per interval.
+const cloudMonitoringFlushInterval = 10 * time.Second
+
+// cloudMonitoringBatchSize is the most TimeSeries entries a single
+// CreateTimeSeries call accepts.
+const cloudMonitoringBatchSize = 200
+
+// cloudMonitoringSeriesKey is the bounded label set identifying one exported
+// time series: op, api, worker id, stalled, cache hit and error class. Its
+// cardinality is bounded by the run's configuration (worker count, API
+// selection, error classes actually seen), unlike a per-sample key.
+type cloudMonitoringSeriesKey struct {
+	op         OpType
+	api        API
+	workerId   int
+	stalled    bool
+	cacheHit   bool
+	errorClass string
+}
+
+// cloudMonitoringAccumulator tracks the running mean latency for a series
+// since the last flush.
+type cloudMonitoringAccumulator struct {
+	sumMs float64
+	count int64
+}
+
+// cloudMonitoringSink buffers samples in memory, keyed by their bounded
+// label set, and exports the mean latency per series once per
+// cloudMonitoringFlushInterval on a background goroutine. This keeps Record
+// off the per-operation hot path: a blocking CreateTimeSeries RPC on every
+// sample would make the benchmark measure GCM export latency instead of
+// GCS, and exporting synchronously per-sample also means most same-label
+// points arrive closer together than Cloud Monitoring's per-series write
+// rate allows.
+type cloudMonitoringSink struct {
+	client    *monitoring.MetricClient
+	projectId string
+
+	mu      sync.Mutex
+	pending map[cloudMonitoringSeriesKey]*cloudMonitoringAccumulator
+
+	dropped int64
+
+	stop      chan struct{}
+	flushDone chan struct{}
+}
+
+// NewCloudMonitoringSink returns a ResultsSink that aggregates samples by
+// their label set and exports the mean latency per series to
+// cloudMonitoringMetricType in projectId every cloudMonitoringFlushInterval.
+func NewCloudMonitoringSink(ctx context.Context, projectId string) (ResultsSink, error) {
+	client, err := monitoring.NewMetricClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("while creating cloud monitoring client: %v", err)
+	}
+
+	s := &cloudMonitoringSink{
+		client:    client,
+		projectId: projectId,
+		pending:   make(map[cloudMonitoringSeriesKey]*cloudMonitoringAccumulator),
+		stop:      make(chan struct{}),
+		flushDone: make(chan struct{}),
+	}
+	go s.flushLoop()
+	return s, nil
+}
+
+// Record aggregates sample into its series' running mean. It never reaches
+// the network, so it doesn't block the worker calling it.
+func (s *cloudMonitoringSink) Record(sample Sample) {
+	key := cloudMonitoringSeriesKey{
+		op:         sample.Op,
+		api:        sample.Api,
+		workerId:   sample.WorkerId,
+		stalled:    sample.Stalled,
+		cacheHit:   sample.CacheHit,
+		errorClass: sample.ErrorClass,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	acc, ok := s.pending[key]
+	if !ok {
+		acc = &cloudMonitoringAccumulator{}
+		s.pending[key] = acc
+	}
+	acc.sumMs += sample.Elapsed.Seconds() * 1000
+	acc.count++
+}
+
+// flushLoop exports the buffered series every cloudMonitoringFlushInterval
+// until Close stops it, then performs one final flush.
+func (s *cloudMonitoringSink) flushLoop() {
+	defer close(s.flushDone)
+
+	ticker := time.NewTicker(cloudMonitoringFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.flush()
+		case <-s.stop:
+			s.flush()
+			return
+		}
+	}
+}
+
+// flush drains the pending series and exports them in batches of at most
+// cloudMonitoringBatchSize, each series getting one point for this interval.
+func (s *cloudMonitoringSink) flush() {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[cloudMonitoringSeriesKey]*cloudMonitoringAccumulator)
+	s.mu.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+
+	now := timestamppb.Now()
+	var batch []*monitoringpb.TimeSeries
+	for key, acc := range pending {
+		batch = append(batch, &monitoringpb.TimeSeries{
+			Metric: &metricpb.Metric{
+				Type: cloudMonitoringMetricType,
+				Labels: map[string]string{
+					"op":        string(key.op),
+					"api":       string(key.api),
+					"worker_id": strconv.Itoa(key.workerId),
+					"stalled":   strconv.FormatBool(key.stalled),
+					"cache_hit": strconv.FormatBool(key.cacheHit),
+					"error":     key.errorClass,
+				},
+			},
+			MetricKind: metricpb.MetricDescriptor_GAUGE,
+			ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			Points: []*monitoringpb.Point{
+				{
+					Interval: &monitoringpb.TimeInterval{EndTime: now},
+					Value: &monitoringpb.TypedValue{
+						Value: &monitoringpb.TypedValue_DoubleValue{
+							DoubleValue: acc.sumMs / float64(acc.count),
+						},
+					},
+				},
+			},
+		})
+
+		if len(batch) == cloudMonitoringBatchSize {
+			s.send(batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		s.send(batch)
+	}
+}
+
+// send issues one CreateTimeSeries call for up to cloudMonitoringBatchSize
+// series. Best-effort: a dropped batch shouldn't abort the benchmark, and
+// failures are tallied instead of logged here since a struggling export path
+// would otherwise print a line every flush; Close reports the total once
+// the run is done.
+func (s *cloudMonitoringSink) send(batch []*monitoringpb.TimeSeries) {
+	req := &monitoringpb.CreateTimeSeriesRequest{
+		Name:       "projects/" + s.projectId,
+		TimeSeries: batch,
+	}
+	if err := s.client.CreateTimeSeries(context.Background(), req); err != nil {
+		atomic.AddInt64(&s.dropped, int64(len(batch)))
+	}
+}
+
+func (s *cloudMonitoringSink) Close() error {
+	close(s.stop)
+	<-s.flushDone
+
+	if dropped := atomic.LoadInt64(&s.dropped); dropped > 0 {
+		fmt.Fprintf(os.Stderr, "cloud monitoring sink: dropped %d series\n", dropped)
+	}
+	return s.client.Close()
+}
+
+// NewResultsSink builds the ResultsSink selected by outputType. path is the
+// destination file for OutputCSV; it's ignored for OutputCloudMonitoring.
+func NewResultsSink(ctx context.Context, outputType OutputType, path string, projectId string) (ResultsSink, error) {
+	switch outputType {
+	case OutputCSV:
+		return NewCsvSink(path)
+	case OutputCloudMonitoring:
+		return NewCloudMonitoringSink(ctx, projectId)
+	default:
+		return nil, fmt.Errorf("unknown output type: %s", outputType)
+	}
+}
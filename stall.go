@@ -0,0 +1,173 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stallRingBufferSize is how many recent latencies are kept per object-size
+// bucket. Large enough to give a stable p99 without the quantile
+// computation (an O(n log n) sort on read) getting expensive.
+const stallRingBufferSize = 2048
+
+// stallSizeBucketBytes buckets objects into 8MiB-wide buckets before
+// tracking their latency distribution, since a 1KiB read and a 1GiB read
+// have nothing in common latency-wise.
+const stallSizeBucketBytes = 8 * 1024 * 1024
+
+// defaultStallRetryBudget caps the number of stall-triggered retries a
+// single run will spend in total, so a systemically slow backend can't turn
+// every read into an unbounded retry storm on top of the existing gax
+// backoff.
+const defaultStallRetryBudget = 10000
+
+// latencyRing is a fixed-size, mutex-guarded ring buffer of recent
+// latencies. The bucket count is small and reads are infrequent relative to
+// object transfer time, so a plain mutex is simpler than a lock-free
+// structure and doesn't show up in profiles.
+type latencyRing struct {
+	mu     sync.Mutex
+	values []time.Duration
+	next   int
+	filled bool
+}
+
+func newLatencyRing(size int) *latencyRing {
+	return &latencyRing{values: make([]time.Duration, size)}
+}
+
+func (r *latencyRing) Add(d time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.values[r.next] = d
+	r.next++
+	if r.next == len(r.values) {
+		r.next = 0
+		r.filled = true
+	}
+}
+
+func (r *latencyRing) Count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.filled {
+		return len(r.values)
+	}
+	return r.next
+}
+
+// Quantile returns the q-th quantile (0 < q < 1) of the samples currently in
+// the ring, or 0 if it's empty.
+func (r *latencyRing) Quantile(q float64) time.Duration {
+	r.mu.Lock()
+	n := r.next
+	if r.filled {
+		n = len(r.values)
+	}
+	if n == 0 {
+		r.mu.Unlock()
+		return 0
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, r.values[:n])
+	r.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(q * float64(n))
+	if idx >= n {
+		idx = n - 1
+	}
+	return sorted[idx]
+}
+
+// sizeBucket rounds size down to the stall-tracking bucket it belongs to.
+func sizeBucket(size int64) int64 {
+	return size / stallSizeBucketBytes
+}
+
+// StallDetector tracks a rolling latency distribution per object-size
+// bucket and decides how long a read may take before it's considered
+// stalled and worth retrying.
+type StallDetector struct {
+	Enabled    bool
+	Quantile   float64
+	Multiplier float64
+	MinSamples int
+	Floor      time.Duration
+
+	retryBudget int64
+
+	mu      sync.Mutex
+	buckets map[int64]*latencyRing
+}
+
+// NewStallDetector builds a StallDetector from the -stall-timeout-* flags.
+// floor is the minimum timeout ever returned by Timeout, regardless of the
+// observed p99, so a handful of unusually fast reads early in a run can't
+// produce a timeout so tight it flags normal reads as stalls.
+func NewStallDetector(enabled bool, quantile, multiplier float64, minSamples int, floor time.Duration) *StallDetector {
+	return &StallDetector{
+		Enabled:     enabled,
+		Quantile:    quantile,
+		Multiplier:  multiplier,
+		MinSamples:  minSamples,
+		Floor:       floor,
+		retryBudget: defaultStallRetryBudget,
+		buckets:     make(map[int64]*latencyRing),
+	}
+}
+
+func (d *StallDetector) ringFor(size int64) *latencyRing {
+	bucket := sizeBucket(size)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ring, ok := d.buckets[bucket]
+	if !ok {
+		ring = newLatencyRing(stallRingBufferSize)
+		d.buckets[bucket] = ring
+	}
+	return ring
+}
+
+// Timeout returns how long a read of the given size may run before it
+// should be treated as stalled, or 0 if stall detection isn't active
+// (disabled, too few samples collected for this size bucket, or the
+// stall-retry budget already spent).
+func (d *StallDetector) Timeout(size int64) time.Duration {
+	if !d.Enabled || atomic.LoadInt64(&d.retryBudget) <= 0 {
+		return 0
+	}
+
+	ring := d.ringFor(size)
+	if ring.Count() < d.MinSamples {
+		return 0
+	}
+
+	p99 := ring.Quantile(d.Quantile)
+	timeout := time.Duration(float64(p99) * d.Multiplier)
+	if timeout < d.Floor {
+		timeout = d.Floor
+	}
+	return timeout
+}
+
+// Record adds a successful read's latency to its size bucket's rolling
+// distribution.
+func (d *StallDetector) Record(size int64, latency time.Duration) {
+	d.ringFor(size).Add(latency)
+}
+
+// TakeRetry consumes one unit of the run's overall stall-retry budget,
+// reporting whether one was available. Once the budget is exhausted, reads
+// stop being retried on stall and simply run to completion (or fail
+// normally), so a systemically slow backend can't cause unbounded retries.
+func (d *StallDetector) TakeRetry() bool {
+	return atomic.AddInt64(&d.retryBudget, -1) >= 0
+}